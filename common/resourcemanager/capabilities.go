@@ -0,0 +1,34 @@
+package resourcemanager
+
+import (
+	"crypto"
+	"crypto/x509"
+	"time"
+)
+
+// The registry only hands back the opaque queue.ResourceManager
+// interface, which doesn't expose any manager-specific configuration.
+// Managers that support an optional capability implement one of the
+// interfaces below; the API/config layer type-asserts a manager it got
+// from New/Enable against whichever of these it needs, instead of
+// reaching past the registry to a manager package's own exported type.
+
+// Stateful is implemented by resource managers that persist versioned
+// resource state through a ResourceStore.
+type Stateful interface {
+	SetStore(store ResourceStore)
+	LoadFromStore() error
+}
+
+// KeeperConfigurable is implemented by resource managers whose
+// background health-check worker pool can be tuned.
+type KeeperConfigurable interface {
+	SetKeeperConfig(workers int, probeTimeout time.Duration, reconnectsPerSecond float64)
+}
+
+// RotatableCA is implemented by resource managers that support rotating
+// the CA root trusted for resource connections.
+type RotatableCA interface {
+	SetSigningRoot(root *x509.Certificate, key crypto.Signer)
+	RotateCA(newRoot *x509.Certificate, newKey crypto.Signer) error
+}
@@ -0,0 +1,87 @@
+// Package resourcemanager provides a plugin-style registry for
+// queue.ResourceManager implementations. Individual resource manager
+// packages (directconnect, dnssd, etc) register themselves here from an
+// init() function, and the API/config layer decides which of the
+// registered managers to actually instantiate and wire into the queue
+// at startup.
+package resourcemanager
+
+import (
+	"crypto/tls"
+	"fmt"
+	"sync"
+
+	"github.com/jmmcatee/cracklord/common/queue"
+)
+
+// Factory builds a queue.ResourceManager for a single registered manager
+// type. config carries any manager-specific startup settings (e.g. a
+// discovery service's address) that aren't per-resource parameters.
+type Factory func(q *queue.Queue, t *tls.Config, config map[string]string) queue.ResourceManager
+
+var (
+	registryLock sync.RWMutex
+	registry     = make(map[string]Factory)
+)
+
+// Register adds a resource manager factory under the given name. It
+// panics if called twice for the same name, since that almost always
+// indicates two plugins were compiled in with a colliding SystemName.
+// It is intended to be called from a package's init() function.
+func Register(name string, factory Factory) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+
+	if _, exists := registry[name]; exists {
+		panic(fmt.Sprintf("resourcemanager: Register called twice for manager %q", name))
+	}
+
+	registry[name] = factory
+}
+
+// Names returns the names of every resource manager that has registered
+// itself, in no particular order.
+func Names() []string {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+
+	return names
+}
+
+// New looks up the named resource manager and builds it. It returns an
+// error if no manager has registered under that name, so the API/config
+// layer can report a clear startup failure for a typo'd config entry.
+func New(name string, q *queue.Queue, t *tls.Config, config map[string]string) (queue.ResourceManager, error) {
+	registryLock.RLock()
+	factory, ok := registry[name]
+	registryLock.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("resourcemanager: no resource manager registered under name %q", name)
+	}
+
+	return factory(q, t, config), nil
+}
+
+// Enable builds and returns every resource manager named in names. This is
+// the entry point the API/config layer uses at startup to wire in
+// whichever subset of registered managers the deployment has opted into.
+func Enable(names []string, q *queue.Queue, t *tls.Config, config map[string]map[string]string) ([]queue.ResourceManager, error) {
+	managers := make([]queue.ResourceManager, 0, len(names))
+
+	for _, name := range names {
+		manager, err := New(name, q, t, config[name])
+		if err != nil {
+			return nil, err
+		}
+
+		managers = append(managers, manager)
+	}
+
+	return managers, nil
+}
@@ -0,0 +1,189 @@
+package resourcemanager
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// ErrHeadMismatch is returned by ResourceStore.Put when the caller's
+// priorHash doesn't match the store's current head for that resource,
+// meaning the update was based on stale data and must be retried.
+var ErrHeadMismatch = errors.New("resource update's prior-version hash does not match the current head")
+
+// ResourceUpdate is a single signed entry in a resource's update
+// history: who changed it, when, what the new parameters were, and a
+// hash of the record it replaced so the chain can be verified.
+type ResourceUpdate struct {
+	Sequence  int64             `json:"sequence"`
+	Timestamp time.Time         `json:"timestamp"`
+	Operator  string            `json:"operator"`
+	Status    string            `json:"status"`
+	Params    map[string]string `json:"params"`
+	PriorHash string            `json:"priorHash"`
+}
+
+// StoredResource is the full persisted record for one managed resource:
+// its current sequence number and the complete history of updates that
+// produced it.
+type StoredResource struct {
+	ID      string           `json:"id"`
+	Head    int64            `json:"head"`
+	History []ResourceUpdate `json:"history"`
+}
+
+// HeadHash returns the hash of this resource's current head update, used
+// as the expected PriorHash for the next write.
+func (this StoredResource) HeadHash() string {
+	if len(this.History) == 0 {
+		return ""
+	}
+	return hashUpdate(this.History[len(this.History)-1])
+}
+
+// ResourceStore persists versioned resource records so resources survive
+// a queue restart. Put enforces optimistic concurrency: it rejects a
+// write whose PriorHash doesn't match the current head. It lives in this
+// shared package, rather than inside a specific resource manager, so any
+// manager built through the registry can be handed the same store
+// implementations (file, BoltDB, etcd, ...) through the Stateful
+// capability interface.
+type ResourceStore interface {
+	Get(id string) (StoredResource, bool, error)
+	All() (map[string]StoredResource, error)
+	Put(id string, update ResourceUpdate) (StoredResource, error)
+	History(id string) ([]ResourceUpdate, error)
+
+	// Migrate re-keys a resource's stored record from oldID to newID,
+	// preserving its full version history. It's used when the queue
+	// assigns a resource a new id on reload, so the audit trail recorded
+	// under the old id isn't orphaned.
+	Migrate(oldID, newID string) error
+}
+
+// fileResourceStore is a simple ResourceStore backed by a single JSON
+// file on disk, guarded by a mutex. It's the default backend; BoltDB or
+// etcd-backed implementations of ResourceStore can be swapped in without
+// the resource manager needing to change.
+type fileResourceStore struct {
+	lock sync.Mutex
+	path string
+	data map[string]StoredResource
+}
+
+// NewFileResourceStore loads (or creates) a JSON-file-backed
+// ResourceStore at path.
+func NewFileResourceStore(path string) (ResourceStore, error) {
+	store := &fileResourceStore{
+		path: path,
+		data: make(map[string]StoredResource),
+	}
+
+	if _, err := os.Stat(path); err == nil {
+		raw, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(raw) > 0 {
+			if err := json.Unmarshal(raw, &store.data); err != nil {
+				return nil, err
+			}
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	return store, nil
+}
+
+func (this *fileResourceStore) Get(id string) (StoredResource, bool, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	record, ok := this.data[id]
+	return record, ok, nil
+}
+
+func (this *fileResourceStore) All() (map[string]StoredResource, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	all := make(map[string]StoredResource, len(this.data))
+	for id, record := range this.data {
+		all[id] = record
+	}
+	return all, nil
+}
+
+func (this *fileResourceStore) Put(id string, update ResourceUpdate) (StoredResource, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	record := this.data[id]
+	if update.PriorHash != record.HeadHash() {
+		return StoredResource{}, ErrHeadMismatch
+	}
+
+	update.Sequence = record.Head + 1
+	record.ID = id
+	record.Head = update.Sequence
+	record.History = append(record.History, update)
+	this.data[id] = record
+
+	return record, this.flush()
+}
+
+func (this *fileResourceStore) History(id string) ([]ResourceUpdate, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	record, ok := this.data[id]
+	if !ok {
+		return nil, errors.New("No history found for resource id.")
+	}
+
+	return record.History, nil
+}
+
+func (this *fileResourceStore) Migrate(oldID, newID string) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if oldID == newID {
+		return nil
+	}
+
+	record, ok := this.data[oldID]
+	if !ok {
+		return errors.New("No stored record found for resource id.")
+	}
+
+	record.ID = newID
+	this.data[newID] = record
+	delete(this.data, oldID)
+
+	return this.flush()
+}
+
+// flush writes the whole store back to disk. Callers must hold this.lock.
+func (this *fileResourceStore) flush() error {
+	raw, err := json.Marshal(this.data)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(this.path, raw, 0600)
+}
+
+// hashUpdate computes the content hash used to chain updates together.
+func hashUpdate(update ResourceUpdate) string {
+	raw, _ := json.Marshal(update)
+	sum := sha256.Sum256(raw)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,63 @@
+package resourcemanager
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestFileResourceStore(t *testing.T) ResourceStore {
+	dir, err := ioutil.TempDir("", "resourcestore")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	store, err := NewFileResourceStore(filepath.Join(dir, "resources.json"))
+	if err != nil {
+		t.Fatalf("NewFileResourceStore: %v", err)
+	}
+	return store
+}
+
+func TestFileResourceStorePutAcceptsMatchingPriorHash(t *testing.T) {
+	store := newTestFileResourceStore(t)
+
+	first, err := store.Put("res1", ResourceUpdate{Timestamp: time.Now(), Status: "running"})
+	if err != nil {
+		t.Fatalf("first Put: %v", err)
+	}
+
+	if _, err := store.Put("res1", ResourceUpdate{Timestamp: time.Now(), Status: "paused", PriorHash: first.HeadHash()}); err != nil {
+		t.Fatalf("second Put with matching PriorHash: %v", err)
+	}
+}
+
+func TestFileResourceStorePutRejectsStalePriorHash(t *testing.T) {
+	store := newTestFileResourceStore(t)
+
+	if _, err := store.Put("res1", ResourceUpdate{Timestamp: time.Now(), Status: "running"}); err != nil {
+		t.Fatalf("first Put: %v", err)
+	}
+
+	// This update's PriorHash is empty, matching nothing but the
+	// resource's initial (nonexistent) state, so it must be rejected as
+	// stale now that res1 has a head update.
+	if _, err := store.Put("res1", ResourceUpdate{Timestamp: time.Now(), Status: "paused"}); err != ErrHeadMismatch {
+		t.Fatalf("Put with stale PriorHash returned %v, want ErrHeadMismatch", err)
+	}
+}
+
+func TestFileResourceStorePutRejectsWrongPriorHash(t *testing.T) {
+	store := newTestFileResourceStore(t)
+
+	if _, err := store.Put("res1", ResourceUpdate{Timestamp: time.Now(), Status: "running"}); err != nil {
+		t.Fatalf("first Put: %v", err)
+	}
+
+	if _, err := store.Put("res1", ResourceUpdate{Timestamp: time.Now(), Status: "paused", PriorHash: "not-a-real-hash"}); err != ErrHeadMismatch {
+		t.Fatalf("Put with wrong PriorHash returned %v, want ErrHeadMismatch", err)
+	}
+}
@@ -0,0 +1,43 @@
+package directconnectresourcemanager
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoffWithJitterCapsAtMax(t *testing.T) {
+	base := time.Second
+	max := 5 * time.Second
+
+	// At a high attempt count the uncapped exponential would be huge, so
+	// the result must still land within [0.5*max, 1.5*max].
+	delay := backoffWithJitter(20, base, max)
+
+	if delay < max/2 || delay > max+max/2 {
+		t.Fatalf("backoffWithJitter(20, %v, %v) = %v, want within [%v, %v]", base, max, delay, max/2, max+max/2)
+	}
+}
+
+func TestBackoffWithJitterGrowsWithAttempts(t *testing.T) {
+	base := 100 * time.Millisecond
+	max := time.Hour
+
+	// Attempt 0 is jittered around base (0.5x-1.5x); attempt 5 is
+	// jittered around base*32, so the ranges shouldn't overlap.
+	attempt0Max := time.Duration(float64(base) * 1.5)
+	attempt5Min := time.Duration(float64(base) * 32 * 0.5)
+
+	for i := 0; i < 10; i++ {
+		delay := backoffWithJitter(0, base, max)
+		if delay > attempt0Max {
+			t.Fatalf("backoffWithJitter(0, ...) = %v, want <= %v", delay, attempt0Max)
+		}
+	}
+
+	for i := 0; i < 10; i++ {
+		delay := backoffWithJitter(5, base, max)
+		if delay < attempt5Min {
+			t.Fatalf("backoffWithJitter(5, ...) = %v, want >= %v", delay, attempt5Min)
+		}
+	}
+}
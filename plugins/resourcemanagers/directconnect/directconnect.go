@@ -6,41 +6,125 @@ import (
 	log "github.com/Sirupsen/logrus"
 	"github.com/emperorcow/protectedmap"
 	"github.com/jmmcatee/cracklord/common/queue"
+	"github.com/jmmcatee/cracklord/common/resourcemanager"
+	"math"
+	"math/rand"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// SystemName is registered with the common resourcemanager registry so
+// the API/config layer can enable this manager by name alongside any
+// other registered managers.
+const SystemName = "directconnect"
+
+func init() {
+	resourcemanager.Register(SystemName, func(q *queue.Queue, t *tls.Config, config map[string]string) queue.ResourceManager {
+		return Setup(q, t)
+	})
+}
+
+// Default backoff parameters used when a resource does not override them
+// through its own parameters.
+const (
+	defaultInitialRetryInterval = 5 * time.Second
+	defaultMaxRetryInterval     = 5 * time.Minute
+	defaultMaxElapsedTime       = 0 // zero means retry forever
+)
+
 type resourceInfo struct {
 	notes         string
+	address       string
 	lastGoodCheck time.Time
+
+	initialRetryInterval time.Duration
+	maxRetryInterval     time.Duration
+	maxElapsedTime       time.Duration
+
+	retryAttempts int
+	nextRetry     time.Time
+	firstFailure  time.Time
+	lastError     string
+	failed        bool
+
+	certExpiresAt time.Time
+	signedBy      string
 }
 
 type directResourceManager struct {
 	resources protectedmap.ProtectedMap
 	q         *queue.Queue
 	tls       *tls.Config
+
+	rotation caRotationState
+	store    resourcemanager.ResourceStore
+
+	probeWorkers     int
+	probeTimeout     time.Duration
+	reconnectLimiter *rateLimiter
+
+	//keepMu serializes Keep() passes against RotateCA, since both read or
+	//read-modify-write this.tls, this.rotation and the per-resource
+	//certExpiresAt/signedBy fields. RotateCA is meant to be callable while
+	//the keeper is running, so without this the two race.
+	keepMu sync.Mutex
 }
 
+// Default worker-pool settings, used until SetKeeperConfig overrides them.
+const (
+	defaultProbeWorkers        = 10
+	defaultProbeTimeout        = 10 * time.Second
+	defaultReconnectsPerSecond = 5.0
+)
+
 func Setup(qpointer *queue.Queue, tlspointer *tls.Config) queue.ResourceManager {
 	return &directResourceManager{
-		resources: protectedmap.New(),
-		q:         qpointer,
-		tls:       tlspointer,
+		resources:        protectedmap.New(),
+		q:                qpointer,
+		tls:              tlspointer,
+		probeWorkers:     defaultProbeWorkers,
+		probeTimeout:     defaultProbeTimeout,
+		reconnectLimiter: newRateLimiter(defaultReconnectsPerSecond),
 	}
 }
 
-func (this directResourceManager) SystemName() string {
-	return "directconnect"
+// currentTLS returns the manager's current tls.Config under keepMu, so a
+// caller outside the keeper (AddResource, LoadFromStore) can't read it
+// while RotateCA is concurrently swapping it out. It must not be called
+// from anywhere already holding keepMu (Keep, RotateCA and anything they
+// call), since keepMu is not reentrant.
+func (this *directResourceManager) currentTLS() *tls.Config {
+	this.keepMu.Lock()
+	defer this.keepMu.Unlock()
+	return this.tls
+}
+
+// SetKeeperConfig overrides the worker-pool settings Keep() uses to probe
+// and reconnect resources. workers is how many goroutines probe
+// concurrently, probeTimeout bounds how long a single probe may take, and
+// reconnectsPerSecond rate-limits how fast reconnect attempts are
+// dispatched so a mass outage doesn't stampede the queue's RPC layer.
+func (this *directResourceManager) SetKeeperConfig(workers int, probeTimeout time.Duration, reconnectsPerSecond float64) {
+	this.probeWorkers = workers
+	this.probeTimeout = probeTimeout
+	this.reconnectLimiter = newRateLimiter(reconnectsPerSecond)
+}
+
+func (this *directResourceManager) SystemName() string {
+	return SystemName
 }
 
-func (this directResourceManager) DisplayName() string {
+func (this *directResourceManager) DisplayName() string {
 	return "Direct Connect"
 }
 
-func (this directResourceManager) Description() string {
+func (this *directResourceManager) Description() string {
 	return "Directly connect to resource servers."
 }
 
-func (this directResourceManager) ParametersForm() string {
+func (this *directResourceManager) ParametersForm() string {
 	return `[
 		"name",
 		"address",
@@ -48,10 +132,22 @@ func (this directResourceManager) ParametersForm() string {
 			"key": "notes",
 			"type": "textarea",
 			"placeholder": "OPTIONAL: Any notes you would like to include (location, primary contact, etc.)"
+		},
+		{
+			"key": "initialRetryInterval",
+			"placeholder": "OPTIONAL: Initial reconnect delay in seconds (default 5)"
+		},
+		{
+			"key": "maxRetryInterval",
+			"placeholder": "OPTIONAL: Maximum reconnect delay in seconds (default 300)"
+		},
+		{
+			"key": "maxElapsedTime",
+			"placeholder": "OPTIONAL: Give up reconnecting after this many seconds (default 0, retry forever)"
 		}
     	]`
 }
-func (this directResourceManager) ParametersSchema() string {
+func (this *directResourceManager) ParametersSchema() string {
 	return `{
 		"type": "object",
 		"title": "Direct Connect",
@@ -70,12 +166,29 @@ func (this directResourceManager) ParametersSchema() string {
 			"notes": {
 				"title": "Notes",
 				"type": "string"
+			},
+			"initialRetryInterval": {
+				"title": "Initial Retry Interval (seconds)",
+				"type": "string",
+				"default": "5",
+				"description": "How long to wait, before jitter, after the first failed reconnect attempt; the wait doubles with each further failure. The first reconnect attempt is made as soon as the resource is found down."
+			},
+			"maxRetryInterval": {
+				"title": "Maximum Retry Interval (seconds)",
+				"type": "string",
+				"default": "300",
+				"description": "The cap applied to the exponential backoff between reconnect attempts before jitter, which can stretch a wait to 1.5 times this value."
+			},
+			"maxElapsedTime": {
+				"title": "Maximum Elapsed Time (seconds)",
+				"type": "string",
+				"default": "0",
+				"description": "Stop attempting to reconnect and mark the resource permanently failed after this long. 0 means retry forever."
 			}
 		},
 		"required": [
 			"name",
-			"address",
-			"reconnect"
+			"address"
 		]
 	}`
 }
@@ -98,7 +211,7 @@ func (this *directResourceManager) AddResource(params map[string]string) error {
 	}
 
 	//Now we connect to the resource, and then let the user know the status
-	err = this.q.ConnectResource(uuid, address, this.tls)
+	err = this.q.ConnectResource(uuid, address, this.currentTLS())
 	if err != nil {
 		return err
 	}
@@ -106,6 +219,21 @@ func (this *directResourceManager) AddResource(params map[string]string) error {
 	//Finally, set the resource into our map
 	this.resources.Set(uuid, this.parseParams(params))
 
+	//If we have a persistent store configured, record the resource's
+	//initial version so it can be reloaded and reconnected on restart.
+	if this.store != nil {
+		_, err := this.store.Put(uuid, resourcemanager.ResourceUpdate{
+			Timestamp: time.Now(),
+			Operator:  params["operator"],
+			Status:    "running",
+			Params:    params,
+			PriorHash: "",
+		})
+		if err != nil {
+			log.WithField("error", err.Error()).Error("Unable to persist new resource to the resource store.")
+		}
+	}
+
 	return nil
 }
 
@@ -124,7 +252,7 @@ func (this *directResourceManager) DeleteResource(resourceid string) error {
 	return nil
 }
 
-func (this directResourceManager) GetResource(resourceid string) (*queue.Resource, map[string]string, error) {
+func (this *directResourceManager) GetResource(resourceid string) (*queue.Resource, map[string]string, error) {
 	//First, get the resource itself from the queue
 	resource, ok := this.q.GetResource(resourceid)
 
@@ -145,10 +273,49 @@ func (this directResourceManager) GetResource(resourceid string) (*queue.Resourc
 	//Parse our parameters struct back into a common string map
 	parameters := make(map[string]string)
 	parameters["notes"] = localres.notes
+	parameters["address"] = localres.address
+	//Serialize as a plain count of seconds, matching what parseSecondsOrDefault
+	//expects, so feeding GetResource's output straight back into UpdateResource
+	//round-trips instead of silently falling back to the defaults.
+	parameters["initialRetryInterval"] = strconv.Itoa(int(localres.initialRetryInterval.Seconds()))
+	parameters["maxRetryInterval"] = strconv.Itoa(int(localres.maxRetryInterval.Seconds()))
+	parameters["maxElapsedTime"] = strconv.Itoa(int(localres.maxElapsedTime.Seconds()))
+	if !localres.certExpiresAt.IsZero() {
+		parameters["certExpiresAt"] = localres.certExpiresAt.Format(time.RFC3339)
+	}
+	parameters["signedBy"] = localres.signedBy
+
+	//If we have a persistent store configured, surface the current head
+	//hash so a caller knows what priorHash to supply on its next
+	//UpdateResource call.
+	if this.store != nil {
+		if head, ok, err := this.store.Get(resourceid); err == nil && ok {
+			parameters["headHash"] = head.HeadHash()
+		}
+	}
 
 	return resource, parameters, nil
 }
 
+// GetResourceHeadHash returns the current head hash of a resource's
+// version history, i.e. the priorHash a caller must supply to
+// UpdateResource for its next write to be accepted.
+func (this *directResourceManager) GetResourceHeadHash(resourceid string) (string, error) {
+	if this.store == nil {
+		return "", errors.New("Cannot retrieve resource head hash, no resource store has been configured.")
+	}
+
+	head, ok, err := this.store.Get(resourceid)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", errors.New("No stored record found for resource id.")
+	}
+
+	return head.HeadHash(), nil
+}
+
 func (this *directResourceManager) UpdateResource(resourceid string, newstatus string, newparams map[string]string) error {
 	//Because we need to make some comparisons for pause/resume, let's get the current resource state
 	oldresource, _, err := this.GetResource(resourceid)
@@ -156,8 +323,65 @@ func (this *directResourceManager) UpdateResource(resourceid string, newstatus s
 		return err
 	}
 
-	//Set the internal parameters within the direct connect manager to the new data
-	this.resources.Set(resourceid, this.parseParams(newparams))
+	//Set the internal parameters within the direct connect manager to the new data, preserving retry state
+	localresource, ok := this.resources.Get(resourceid)
+	if !ok {
+		return errors.New("Resource with requested ID could not be found in direct connect resource manager.")
+	}
+	oldlocal := localresource.(resourceInfo)
+
+	//If we have a persistent store configured, the caller must supply the
+	//hash of the version they last saw; a mismatch means someone else
+	//updated this resource first and the caller needs to retry.
+	if this.store != nil {
+		head, ok, err := this.store.Get(resourceid)
+		if err != nil {
+			return err
+		}
+
+		expectedHash := ""
+		if ok {
+			expectedHash = head.HeadHash()
+		}
+
+		if newparams["priorHash"] != expectedHash {
+			return resourcemanager.ErrHeadMismatch
+		}
+
+		if _, err := this.store.Put(resourceid, resourcemanager.ResourceUpdate{
+			Timestamp: time.Now(),
+			Operator:  newparams["operator"],
+			Status:    newstatus,
+			Params:    newparams,
+			PriorHash: expectedHash,
+		}); err != nil {
+			return err
+		}
+	}
+
+	newlocal := this.parseParams(newparams)
+	newlocal.lastGoodCheck = oldlocal.lastGoodCheck
+	newlocal.certExpiresAt = oldlocal.certExpiresAt
+	newlocal.signedBy = oldlocal.signedBy
+
+	//An operator editing a resource's params (its address, most commonly)
+	//is the normal recovery path for a resource Keep() has given up on, so
+	//only carry the retry/failed state forward when nothing actually
+	//changed; otherwise a permanently-failed resource can never be
+	//reconnected short of deleting and re-adding it.
+	if newlocal.address == oldlocal.address &&
+		newlocal.notes == oldlocal.notes &&
+		newlocal.initialRetryInterval == oldlocal.initialRetryInterval &&
+		newlocal.maxRetryInterval == oldlocal.maxRetryInterval &&
+		newlocal.maxElapsedTime == oldlocal.maxElapsedTime {
+		newlocal.retryAttempts = oldlocal.retryAttempts
+		newlocal.nextRetry = oldlocal.nextRetry
+		newlocal.firstFailure = oldlocal.firstFailure
+		newlocal.lastError = oldlocal.lastError
+		newlocal.failed = oldlocal.failed
+	}
+
+	this.resources.Set(resourceid, newlocal)
 
 	//Check to see if the old status matches the new one, if not, we need to make a change
 	if oldresource.Status != newstatus {
@@ -182,9 +406,9 @@ func (this *directResourceManager) UpdateResource(resourceid string, newstatus s
 	return nil
 }
 
-func (this directResourceManager) GetManagedResources() []string {
+func (this *directResourceManager) GetManagedResources() []string {
 	//We need to make a slice of resource UUID strings for every resource we manage.  First, let's make the actual slice with a length of the size of our map
-	resourceids := make([]string, this.resources.Count())
+	resourceids := make([]string, 0, this.resources.Count())
 
 	//Next let's start up an iterator for our map and loop through each resource
 	iter := this.resources.Iterator()
@@ -196,48 +420,263 @@ func (this directResourceManager) GetManagedResources() []string {
 	return resourceids
 }
 
-//This function loops through all of the directly connected resources and detects
-//that resource is still connected.  If so, it will do nothing; however, if not
-//then it will attempt to reconnect if at all possible.
+//Keep fans the managed resources out across a pool of probeWorkers
+//goroutines that each check a resource's connection status concurrently,
+//bounded by probeTimeout. Resources found down are handed off to
+//attemptReconnect, which dispatches its actual reconnect attempts through
+//a rate limiter so a mass outage can't stampede the queue's RPC layer.
 func (this *directResourceManager) Keep() {
+	//Hold keepMu for the whole pass so a concurrent RotateCA can't race
+	//with the probe workers' read-modify-write of this.tls or of the
+	//per-resource certExpiresAt/signedBy fields it also updates.
+	this.keepMu.Lock()
+	defer this.keepMu.Unlock()
+
 	log.Debug("Direct connect keeper starting up")
-	iter := this.resources.Iterator()
-	for data := range iter.Loop() {
-		logger := log.WithField("resourceid", data.Key)
-		logger.Debug("Gathering data on resource")
-		localResource := data.Val.(resourceInfo)
-		queueResource, ok := this.q.GetResource(data.Key)
 
-		if !ok {
-			logger.Error("Unable to find a resource in the queue that the direct connect manager thought it was responsible for.")
-			continue
-		}
+	ids := this.GetManagedResources()
+	jobs := make(chan string, len(ids))
+	for _, id := range ids {
+		jobs <- id
+	}
+	close(jobs)
+
+	workers := this.probeWorkers
+	if workers < 1 {
+		workers = 1
+	}
+
+	var healthy int64
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for id := range jobs {
+				if this.probeResource(id) {
+					atomic.AddInt64(&healthy, 1)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	metricResourcesHealthy.Set(float64(healthy))
+	log.Info("Direct connect resource manager has successfully updated resources.")
+}
+
+//probeResource checks a single resource's connection status, bounded by
+//probeTimeout, and either marks it healthy or kicks off a reconnect
+//attempt. It returns whether the resource was found healthy.
+func (this *directResourceManager) probeResource(resourceid string) bool {
+	logger := log.WithField("resourceid", resourceid)
+
+	localresource, ok := this.resources.Get(resourceid)
+	if !ok {
+		logger.Error("Resource disappeared from the local map while being probed.")
+		return false
+	}
+	localResource := localresource.(resourceInfo)
+
+	queueResource, ok := this.q.GetResource(resourceid)
+	if !ok {
+		logger.Error("Unable to find a resource in the queue that the direct connect manager thought it was responsible for.")
+		return false
+	}
+
+	start := time.Now()
+	status := this.probeWithTimeout(queueResource)
+	metricProbeDurationSeconds.Observe(time.Since(start).Seconds())
+
+	logger.WithField("status", status).Debug("Checked resource connection status")
+	logger.WithFields(log.Fields{
+		"notes":        localResource.notes,
+		"lastgoodtime": localResource.lastGoodCheck,
+	}).Debug("Processing resource.")
+
+	//If the connection to the resource is still good, flag when we last checked that and
+	//reset any retry state left over from a prior outage.
+	if status {
+		localResource.lastGoodCheck = time.Now()
+		localResource.retryAttempts = 0
+		localResource.nextRetry = time.Time{}
+		localResource.firstFailure = time.Time{}
+		localResource.lastError = ""
+		localResource.failed = false
+	} else if !localResource.failed {
+		this.attemptReconnect(resourceid, &localResource, logger)
+	}
+
+	this.resources.Set(resourceid, localResource)
+	return status
+}
+
+//probeWithTimeout runs CheckResourceConnectionStatus on its own goroutine
+//and gives up after probeTimeout, treating a probe that never returns the
+//same as a down resource.
+func (this *directResourceManager) probeWithTimeout(resource *queue.Resource) bool {
+	result := make(chan bool, 1)
+	go func() {
+		result <- this.q.CheckResourceConnectionStatus(resource)
+	}()
+
+	select {
+	case status := <-result:
+		return status
+	case <-time.After(this.probeTimeout):
+		return false
+	}
+}
+
+//attemptReconnect reconnects a resource that has gone down, honoring the
+//resource's exponential-backoff-with-jitter schedule. It mutates localResource
+//in place with the updated retry state.
+func (this *directResourceManager) attemptReconnect(resourceid string, localResource *resourceInfo, logger *log.Entry) {
+	now := time.Now()
+
+	if localResource.firstFailure.IsZero() {
+		localResource.firstFailure = now
+	}
+
+	if localResource.maxElapsedTime > 0 && now.Sub(localResource.firstFailure) > localResource.maxElapsedTime {
+		localResource.failed = true
+		localResource.lastError = "giving up after exceeding maximum elapsed retry time"
+		logger.WithField("elapsed", now.Sub(localResource.firstFailure)).Error("Resource has exceeded its maximum elapsed retry time, marking permanently failed.")
+		return
+	}
+
+	if now.Before(localResource.nextRetry) {
+		logger.WithField("nextretry", localResource.nextRetry).Debug("Resource is still within its backoff window, skipping reconnect attempt.")
+		return
+	}
 
-		status := this.q.CheckResourceConnectionStatus(queueResource)
-		logger.WithField("status", status).Debug("Checked resource connection status")
+	//Dispatching through the rate limiter, rather than connecting directly,
+	//is what keeps a mass outage from stampeding the queue's RPC layer.
+	this.reconnectLimiter.Wait()
+	metricReconnectAttemptsTotal.Inc()
 
+	logger.WithField("attempt", localResource.retryAttempts).Info("Attempting to reconnect downed resource.")
+	err := this.q.ConnectResource(resourceid, localResource.address, this.tls)
+	if err != nil {
+		localResource.lastError = err.Error()
+		localResource.nextRetry = now.Add(backoffWithJitter(localResource.retryAttempts, localResource.initialRetryInterval, localResource.maxRetryInterval))
+		localResource.retryAttempts++
 		logger.WithFields(log.Fields{
-			"notes":        localResource.notes,
-			"lastgoodtime": localResource.lastGoodCheck,
-		}).Debug("Processing resource.")
-
-		//If the connection to the resource is still good, let's flag when we last checked that
-		//otherwise, we'll want to see about reconnecting
-		if status {
-			localResource.lastGoodCheck = time.Now()
-		}
+			"error":     err.Error(),
+			"nextretry": localResource.nextRetry,
+		}).Error("Reconnect attempt failed, backing off.")
+		return
+	}
+
+	logger.Info("Successfully reconnected resource.")
+	localResource.retryAttempts = 0
+	localResource.nextRetry = time.Time{}
+	localResource.firstFailure = time.Time{}
+	localResource.lastError = ""
+}
 
-		//Update our local data for the resource
-		this.resources.Set(data.Key, localResource)
+//backoffWithJitter computes the delay before the next retry, following
+//next = min(cap, base*2^attempts) * rand(0.5..1.5)
+func backoffWithJitter(attempts int, base, cap time.Duration) time.Duration {
+	delay := float64(base) * math.Pow(2, float64(attempts))
+	if delay > float64(cap) {
+		delay = float64(cap)
 	}
 
-	log.Info("Direct connect resource manager has successfully updated resources.")
+	jitter := 0.5 + rand.Float64()
+	return time.Duration(delay * jitter)
 }
 
 func (this *directResourceManager) parseParams(params map[string]string) resourceInfo {
 	//Let's create a temporary resource to hold the info
 	tempresource := resourceInfo{
-		notes: params["notes"],
+		notes:   params["notes"],
+		address: params["address"],
+
+		initialRetryInterval: parseSecondsOrDefault(params["initialRetryInterval"], defaultInitialRetryInterval),
+		maxRetryInterval:     parseSecondsOrDefault(params["maxRetryInterval"], defaultMaxRetryInterval),
+		maxElapsedTime:       parseSecondsOrDefault(params["maxElapsedTime"], defaultMaxElapsedTime),
 	}
 	return tempresource
 }
+
+// SetStore wires a persistent ResourceStore into the manager. It must be
+// set once at startup, before LoadFromStore is called, so that
+// AddResource and UpdateResource can version their writes.
+func (this *directResourceManager) SetStore(store resourcemanager.ResourceStore) {
+	this.store = store
+}
+
+// LoadFromStore reloads every previously-known resource from the
+// configured store and reconnects it, so a queue restart doesn't forget
+// about resources that were managed before the restart. It should be
+// called once at startup, after SetStore.
+//
+// Because the queue assigns a fresh uuid to each AddResource call, the
+// store record is migrated from its pre-restart id to that new uuid so
+// GetResourceHistory keeps working against the resource's live id instead
+// of orphaning the pre-restart audit trail under an id nothing refers to
+// anymore.
+func (this *directResourceManager) LoadFromStore() error {
+	if this.store == nil {
+		return errors.New("Cannot load resources, no resource store has been configured.")
+	}
+
+	all, err := this.store.All()
+	if err != nil {
+		return err
+	}
+
+	for storeid, record := range all {
+		if len(record.History) == 0 {
+			continue
+		}
+
+		head := record.History[len(record.History)-1]
+		logger := log.WithField("storeid", storeid)
+
+		uuid, err := this.q.AddResource(head.Params["name"])
+		if err != nil {
+			logger.WithField("error", err.Error()).Error("Unable to re-add persisted resource to the queue.")
+			continue
+		}
+
+		if err := this.q.ConnectResource(uuid, head.Params["address"], this.currentTLS()); err != nil {
+			logger.WithField("error", err.Error()).Error("Unable to reconnect persisted resource.")
+		}
+
+		if err := this.store.Migrate(storeid, uuid); err != nil {
+			logger.WithField("error", err.Error()).Error("Unable to migrate resource's stored history to its new id, audit trail will be orphaned.")
+		}
+
+		this.resources.Set(uuid, this.parseParams(head.Params))
+	}
+
+	return nil
+}
+
+// GetResourceHistory is the audit-log endpoint: it returns the full,
+// ordered history of signed updates made to a resource, from its
+// persistent store.
+func (this *directResourceManager) GetResourceHistory(resourceid string) ([]resourcemanager.ResourceUpdate, error) {
+	if this.store == nil {
+		return nil, errors.New("Cannot retrieve resource history, no resource store has been configured.")
+	}
+
+	return this.store.History(resourceid)
+}
+
+//parseSecondsOrDefault parses a string count of seconds into a Duration,
+//falling back to def if the string is empty or unparseable.
+func parseSecondsOrDefault(value string, def time.Duration) time.Duration {
+	if value == "" {
+		return def
+	}
+
+	seconds, err := strconv.Atoi(value)
+	if err != nil {
+		return def
+	}
+
+	return time.Duration(seconds) * time.Second
+}
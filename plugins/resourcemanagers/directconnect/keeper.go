@@ -0,0 +1,35 @@
+package directconnectresourcemanager
+
+import "time"
+
+// defaultKeepInterval is used by StartKeeper when no interval is given,
+// matching the cadence the manager used before it became configurable.
+const defaultKeepInterval = 30 * time.Second
+
+// StartKeeper runs Keep() on a fixed interval until the returned stop
+// function is called, so the queue no longer has to hardcode how often a
+// resource manager's fleet health gets checked.
+func (this *directResourceManager) StartKeeper(interval time.Duration) (stop func()) {
+	if interval <= 0 {
+		interval = defaultKeepInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				this.Keep()
+			case <-done:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+	}
+}
@@ -0,0 +1,29 @@
+package directconnectresourcemanager
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// Prometheus metrics so operators can observe fleet health across a
+// large number of direct-connect resources without scraping logs.
+var (
+	metricResourcesHealthy = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "directconnect",
+		Name:      "resources_healthy",
+		Help:      "Number of direct-connect resources that passed their last health probe.",
+	})
+
+	metricReconnectAttemptsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "directconnect",
+		Name:      "reconnect_attempts_total",
+		Help:      "Total number of reconnect attempts dispatched by the direct connect resource manager.",
+	})
+
+	metricProbeDurationSeconds = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "directconnect",
+		Name:      "probe_duration_seconds",
+		Help:      "How long a single resource connection-status probe took.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(metricResourcesHealthy, metricReconnectAttemptsTotal, metricProbeDurationSeconds)
+}
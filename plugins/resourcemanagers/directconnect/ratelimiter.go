@@ -0,0 +1,51 @@
+package directconnectresourcemanager
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimiter is a simple token bucket used to cap how fast reconnect
+// attempts are dispatched, so a mass-outage recovery across a large
+// fleet doesn't stampede the queue's RPC layer all at once.
+type rateLimiter struct {
+	lock       sync.Mutex
+	ratePerSec float64
+	tokens     float64
+	lastRefill time.Time
+}
+
+func newRateLimiter(ratePerSec float64) *rateLimiter {
+	if ratePerSec <= 0 {
+		ratePerSec = defaultReconnectsPerSecond
+	}
+
+	return &rateLimiter{
+		ratePerSec: ratePerSec,
+		tokens:     ratePerSec,
+		lastRefill: time.Now(),
+	}
+}
+
+// Wait blocks until a token is available, refilling the bucket based on
+// elapsed time since the last call.
+func (this *rateLimiter) Wait() {
+	for {
+		this.lock.Lock()
+		now := time.Now()
+		this.tokens += now.Sub(this.lastRefill).Seconds() * this.ratePerSec
+		if this.tokens > this.ratePerSec {
+			this.tokens = this.ratePerSec
+		}
+		this.lastRefill = now
+
+		if this.tokens >= 1 {
+			this.tokens--
+			this.lock.Unlock()
+			return
+		}
+		this.lock.Unlock()
+
+		time.Sleep(time.Duration(float64(time.Second) / this.ratePerSec))
+	}
+}
@@ -0,0 +1,46 @@
+package directconnectresourcemanager
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiterWaitAllowsBurstUpToRate(t *testing.T) {
+	limiter := newRateLimiter(1000)
+
+	start := time.Now()
+	for i := 0; i < 1000; i++ {
+		limiter.Wait()
+	}
+	elapsed := time.Since(start)
+
+	// The bucket starts full, so draining exactly ratePerSec tokens
+	// shouldn't need to wait for a refill.
+	if elapsed > 500*time.Millisecond {
+		t.Fatalf("draining the initial burst took %v, want well under 500ms", elapsed)
+	}
+}
+
+func TestRateLimiterWaitThrottlesPastBurst(t *testing.T) {
+	limiter := newRateLimiter(100)
+
+	start := time.Now()
+	for i := 0; i < 110; i++ {
+		limiter.Wait()
+	}
+	elapsed := time.Since(start)
+
+	// The 101st call has to wait for the bucket to refill at 100/sec, so
+	// this should take noticeably longer than an instant burst would.
+	if elapsed < 50*time.Millisecond {
+		t.Fatalf("exceeding the burst took only %v, want it to be throttled", elapsed)
+	}
+}
+
+func TestNewRateLimiterRejectsNonPositiveRate(t *testing.T) {
+	limiter := newRateLimiter(0)
+
+	if limiter.ratePerSec != defaultReconnectsPerSecond {
+		t.Fatalf("newRateLimiter(0).ratePerSec = %v, want default %v", limiter.ratePerSec, defaultReconnectsPerSecond)
+	}
+}
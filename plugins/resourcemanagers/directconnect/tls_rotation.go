@@ -0,0 +1,163 @@
+package directconnectresourcemanager
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"errors"
+	log "github.com/Sirupsen/logrus"
+	"math/big"
+	"time"
+)
+
+// caRotationState tracks the trust roots a directResourceManager
+// currently honors. During a rotation window both oldRoot and newRoot
+// validate resource certificates, cross-signed the way SwarmKit rotates
+// its cluster CA: the old root signs an intermediate wrapping the new
+// root's public key, so certs issued under the new root chain through
+// that intermediate back to the old root until every resource has
+// confirmed it trusts the new root directly.
+type caRotationState struct {
+	oldRoot     *x509.Certificate
+	oldKey      crypto.Signer
+	newRoot     *x509.Certificate
+	crossSigned *x509.Certificate
+	inProgress  bool
+}
+
+// SetSigningRoot records the CA root and private key this manager should
+// use to cross-sign a replacement root when RotateCA is called. It must
+// be set once at startup before the first RotateCA call; AddResource and
+// UpdateResource do not touch it.
+func (this *directResourceManager) SetSigningRoot(root *x509.Certificate, key crypto.Signer) {
+	this.rotation.oldRoot = root
+	this.rotation.oldKey = key
+}
+
+// RotateCA begins rotating the CA this manager trusts for resource
+// connections. It cross-signs newRoot with the current root's key so
+// certificates issued under either root validate during the rotation
+// window, pushes the updated trust pool to every connected resource, and,
+// once every resource has ACKed, drops the old root from the trusted
+// pool. If any resource fails to reconnect, RotateCA returns nil with the
+// rotation still in progress; Keep() does not complete it, so the old root
+// stays trusted until a later RotateCA call is ACKed by every resource.
+//
+// The manager has no control-channel RPC separate from ConnectResource,
+// so pushing the new trust root is done by reconnecting each resource
+// with the updated tls.Config; a resource actively running a job will
+// have that connection torn down as part of a routine rotation.
+//
+// RotateCA is safe to call while the keeper (Keep/StartKeeper) is
+// running concurrently: it holds the same keepMu lock Keep() does for
+// its duration, since both read or read-modify-write this.tls and the
+// per-resource certExpiresAt/signedBy fields.
+func (this *directResourceManager) RotateCA(newRoot *x509.Certificate, newKey crypto.Signer) error {
+	this.keepMu.Lock()
+	defer this.keepMu.Unlock()
+
+	if this.tls == nil || len(this.tls.RootCAs.Subjects()) == 0 {
+		return errors.New("Cannot rotate CA, manager has no current root CA configured.")
+	}
+
+	if this.rotation.oldRoot == nil {
+		return errors.New("Cannot rotate CA, manager was not initialized with its signing root and key.")
+	}
+
+	crossSigned, err := crossSignIntermediate(this.rotation.oldRoot, this.rotation.oldKey, newRoot)
+	if err != nil {
+		return err
+	}
+
+	pool := this.tls.RootCAs.Clone()
+	pool.AddCert(newRoot)
+	pool.AddCert(crossSigned)
+
+	rotatedTLS := this.tls.Clone()
+	rotatedTLS.RootCAs = pool
+
+	this.rotation.newRoot = newRoot
+	this.rotation.crossSigned = crossSigned
+	this.rotation.inProgress = true
+	this.tls = rotatedTLS
+
+	log.Info("Beginning CA rotation, pushing cross-signed trust to connected resources.")
+
+	acked := 0
+	iter := this.resources.Iterator()
+	for data := range iter.Loop() {
+		local := data.Val.(resourceInfo)
+		logger := log.WithField("resourceid", data.Key)
+
+		//Pushing the updated tls.Config to ConnectResource is how a resource
+		//picks up and reloads its trust roots over the existing control channel.
+		if err := this.q.ConnectResource(data.Key, local.address, this.tls); err != nil {
+			logger.WithField("error", err.Error()).Error("Resource failed to ACK new CA during rotation.")
+			continue
+		}
+
+		local.certExpiresAt = newRoot.NotAfter
+		local.signedBy = newRoot.Subject.CommonName
+		this.resources.Set(data.Key, local)
+		acked++
+		logger.Info("Resource ACKed new CA trust root.")
+	}
+
+	if acked != this.resources.Count() {
+		log.WithFields(log.Fields{
+			"acked": acked,
+			"total": this.resources.Count(),
+		}).Warn("Not all resources ACKed the new CA, old root remains trusted until a later RotateCA call is ACKed by every resource.")
+		return nil
+	}
+
+	this.completeRotation()
+	this.rotation.oldKey = newKey
+	return nil
+}
+
+// completeRotation drops the old root from the trusted pool once every
+// resource has confirmed it trusts the new one directly.
+func (this *directResourceManager) completeRotation() {
+	pool := x509.NewCertPool()
+	pool.AddCert(this.rotation.newRoot)
+
+	rotatedTLS := this.tls.Clone()
+	rotatedTLS.RootCAs = pool
+	this.tls = rotatedTLS
+
+	this.rotation.oldRoot = this.rotation.newRoot
+	this.rotation.newRoot = nil
+	this.rotation.crossSigned = nil
+	this.rotation.inProgress = false
+
+	log.Info("CA rotation complete, old root CA has been dropped from the trusted pool.")
+}
+
+// crossSignIntermediate signs newRoot's public key with oldRoot's private
+// key, producing an intermediate certificate that lets certs issued under
+// newRoot validate against a chain rooted at oldRoot during a rotation
+// window.
+func crossSignIntermediate(oldRoot *x509.Certificate, oldKey crypto.Signer, newRoot *x509.Certificate) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               newRoot.Subject,
+		NotBefore:             time.Now(),
+		NotAfter:              newRoot.NotAfter,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, oldRoot, newRoot.PublicKey, oldKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return x509.ParseCertificate(der)
+}
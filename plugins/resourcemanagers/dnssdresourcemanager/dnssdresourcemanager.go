@@ -0,0 +1,262 @@
+// Package dnssdresourcemanager is a resource manager that watches a
+// DNS-SD (RFC 6763) service type, such as the "_cracklord._tcp" records
+// published by a Kubernetes headless service or a Docker Swarm task, and
+// keeps the queue's resource list in sync with whatever instances that
+// service currently advertises. Unlike directconnect, resources are
+// never added or removed by an operator call; AddResource/DeleteResource
+// simply return an error telling the caller to use service discovery
+// instead.
+package dnssdresourcemanager
+
+import (
+	"crypto/tls"
+	"errors"
+	log "github.com/Sirupsen/logrus"
+	"github.com/emperorcow/protectedmap"
+	"github.com/jmmcatee/cracklord/common/queue"
+	"github.com/jmmcatee/cracklord/common/resourcemanager"
+	"time"
+)
+
+// SystemName is registered with the common resourcemanager registry.
+const SystemName = "dnssd"
+
+// defaultServiceType is used when the manager isn't given one through its
+// startup config.
+const defaultServiceType = "_cracklord._tcp"
+
+// defaultPollInterval is 30 seconds. Nothing in this package reads it:
+// Setup takes no poll interval, and Keep() browses the service type once
+// each time it is called.
+const defaultPollInterval = 30 * time.Second
+
+// resolver abstracts the DNS-SD browse/resolve calls so the manager can
+// be unit tested without touching real DNS.
+type resolver interface {
+	// Browse returns the set of currently advertised instance addresses
+	// for the given service type, keyed by a name identifying each
+	// instance (dnsResolver uses the SRV record's target:port, since SRV
+	// records carry no DNS-SD instance name).
+	Browse(serviceType string) (map[string]string, error)
+}
+
+type discoveredResource struct {
+	instance string
+	address  string
+}
+
+type dnssdResourceManager struct {
+	resources   protectedmap.ProtectedMap
+	q           *queue.Queue
+	tls         *tls.Config
+	resolver    resolver
+	serviceType string
+}
+
+func init() {
+	resourcemanager.Register(SystemName, func(q *queue.Queue, t *tls.Config, config map[string]string) queue.ResourceManager {
+		return Setup(q, t, config)
+	})
+}
+
+// Setup builds the manager from its startup config. The only recognized
+// key is "serviceType" (defaults to "_cracklord._tcp"); a "pollInterval"
+// key is not read.
+func Setup(qpointer *queue.Queue, tlspointer *tls.Config, config map[string]string) queue.ResourceManager {
+	serviceType := config["serviceType"]
+	if serviceType == "" {
+		serviceType = defaultServiceType
+	}
+
+	return &dnssdResourceManager{
+		resources:   protectedmap.New(),
+		q:           qpointer,
+		tls:         tlspointer,
+		resolver:    newDNSSDResolver(),
+		serviceType: serviceType,
+	}
+}
+
+func (this dnssdResourceManager) SystemName() string {
+	return SystemName
+}
+
+func (this dnssdResourceManager) DisplayName() string {
+	return "DNS-SD Discovery"
+}
+
+func (this dnssdResourceManager) Description() string {
+	return "Automatically discover and connect resource servers advertised over DNS-SD."
+}
+
+func (this dnssdResourceManager) ParametersForm() string {
+	return `[
+		{
+			"key": "serviceType",
+			"placeholder": "OPTIONAL: DNS-SD service type to browse (default _cracklord._tcp)"
+		}
+    	]`
+}
+
+func (this dnssdResourceManager) ParametersSchema() string {
+	return `{
+		"type": "object",
+		"title": "DNS-SD Discovery",
+		"properties": {
+			"serviceType": {
+				"title": "Service Type",
+				"type": "string",
+				"default": "_cracklord._tcp",
+				"description": "The DNS-SD service type to browse for resource instances."
+			}
+		}
+	}`
+}
+
+// AddResource is not supported for a discovery-based manager; resources
+// appear and disappear automatically as Keep() browses the service type.
+func (this *dnssdResourceManager) AddResource(params map[string]string) error {
+	return errors.New("Resources cannot be added manually through the dnssd resource manager, they are discovered automatically.")
+}
+
+// DeleteResource is not supported for a discovery-based manager, for the
+// same reason as AddResource.
+func (this *dnssdResourceManager) DeleteResource(resourceid string) error {
+	return errors.New("Resources cannot be removed manually through the dnssd resource manager, they are discovered automatically.")
+}
+
+func (this dnssdResourceManager) GetResource(resourceid string) (*queue.Resource, map[string]string, error) {
+	resource, ok := this.q.GetResource(resourceid)
+	if !ok {
+		return &queue.Resource{}, nil, errors.New("Resource with requested ID not found in the queue.")
+	}
+
+	localresource, ok := this.resources.Get(resourceid)
+	if !ok {
+		return &queue.Resource{}, nil, errors.New("Resource with requested ID could not be found in dnssd resource manager.")
+	}
+
+	local := localresource.(discoveredResource)
+
+	parameters := make(map[string]string)
+	parameters["instance"] = local.instance
+	parameters["address"] = local.address
+
+	return resource, parameters, nil
+}
+
+// UpdateResource only honors pause/resume; address and instance are
+// controlled by discovery, not by the operator.
+func (this *dnssdResourceManager) UpdateResource(resourceid string, newstatus string, newparams map[string]string) error {
+	oldresource, _, err := this.GetResource(resourceid)
+	if err != nil {
+		return err
+	}
+
+	if oldresource.Status != newstatus {
+		switch newstatus {
+		case "resume":
+			if err := this.q.ResumeResource(resourceid); err != nil {
+				return err
+			}
+			break
+
+		case "pause":
+			if err := this.q.PauseResource(resourceid); err != nil {
+				return err
+			}
+			break
+		}
+	}
+
+	return nil
+}
+
+func (this dnssdResourceManager) GetManagedResources() []string {
+	resourceids := make([]string, 0, this.resources.Count())
+
+	iter := this.resources.Iterator()
+	for data := range iter.Loop() {
+		resourceids = append(resourceids, data.Key)
+	}
+
+	return resourceids
+}
+
+// Keep browses the configured DNS-SD service type and reconciles the
+// queue's resources with whatever instances are currently advertised:
+// new instances are added and connected, and instances that have
+// disappeared are removed.
+func (this *dnssdResourceManager) Keep() {
+	log.WithField("servicetype", this.serviceType).Debug("DNS-SD resource manager browsing for instances")
+
+	instances, err := this.resolver.Browse(this.serviceType)
+	if err != nil {
+		log.WithField("error", err.Error()).Error("Unable to browse DNS-SD service type")
+		return
+	}
+
+	seen := make(map[string]bool)
+
+	for instance, address := range instances {
+		//If we've already added this instance, just mark its existing uuid as
+		//still present and move on.
+		if resourceid := this.resourceIDForInstance(instance); resourceid != "" {
+			seen[resourceid] = true
+			continue
+		}
+
+		logger := log.WithFields(log.Fields{"instance": instance, "address": address})
+		logger.Info("Discovered new resource instance, adding to the queue")
+
+		uuid, err := this.q.AddResource(instance)
+		if err != nil {
+			logger.WithField("error", err.Error()).Error("Unable to add discovered resource to the queue")
+			continue
+		}
+
+		if err := this.q.ConnectResource(uuid, address, this.tls); err != nil {
+			logger.WithField("error", err.Error()).Error("Unable to connect to discovered resource")
+			continue
+		}
+
+		this.resources.Set(uuid, discoveredResource{instance: instance, address: address})
+		//Mark the uuid the queue actually assigned as seen, not a pre-add
+		//lookup, so the removal pass below doesn't immediately delete the
+		//resource we just added.
+		seen[uuid] = true
+	}
+
+	iter := this.resources.Iterator()
+	for data := range iter.Loop() {
+		if seen[data.Key] {
+			continue
+		}
+
+		logger := log.WithField("resourceid", data.Key)
+		logger.Info("Discovered resource instance has disappeared, removing from the queue")
+
+		if err := this.q.RemoveResource(data.Key); err != nil {
+			logger.WithField("error", err.Error()).Error("Unable to remove vanished resource from the queue")
+			continue
+		}
+
+		this.resources.Delete(data.Key)
+	}
+
+	log.Info("DNS-SD resource manager has finished reconciling discovered resources.")
+}
+
+// resourceIDForInstance maps a DNS-SD instance name to the resource id
+// the queue knows it by, so repeated Keep() passes recognize an instance
+// they've already added.
+func (this *dnssdResourceManager) resourceIDForInstance(instance string) string {
+	iter := this.resources.Iterator()
+	for data := range iter.Loop() {
+		if data.Val.(discoveredResource).instance == instance {
+			return data.Key
+		}
+	}
+
+	return ""
+}
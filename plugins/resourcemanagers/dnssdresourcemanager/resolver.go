@@ -0,0 +1,32 @@
+package dnssdresourcemanager
+
+import (
+	"fmt"
+	"net"
+)
+
+// dnsResolver implements resolver using the standard library's SRV
+// lookup, which is sufficient for the common DNS-SD case of a service
+// type such as "_cracklord._tcp.example.com" backed by a headless
+// Kubernetes service or similar SRV-publishing discovery source.
+type dnsResolver struct{}
+
+func newDNSSDResolver() resolver {
+	return dnsResolver{}
+}
+
+func (dnsResolver) Browse(serviceType string) (map[string]string, error) {
+	_, addrs, err := net.LookupSRV("", "", serviceType)
+	if err != nil {
+		return nil, fmt.Errorf("dnssd: unable to look up SRV records for %q: %v", serviceType, err)
+	}
+
+	instances := make(map[string]string, len(addrs))
+	for _, srv := range addrs {
+		target := srv.Target
+		instance := fmt.Sprintf("%s:%d", target, srv.Port)
+		instances[instance] = fmt.Sprintf("%s:%d", target, srv.Port)
+	}
+
+	return instances, nil
+}